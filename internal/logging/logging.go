@@ -0,0 +1,60 @@
+// Package logging builds the shared zap logger configuration used by both
+// the simulator and the ingest server, so the two binaries agree on field
+// names and on how --logLevel/--logFormat map to zap settings.
+package logging
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// New builds a *zap.Logger for the given level ("debug"|"info"|"warn"|"error")
+// and format ("console"|"json"). json is what a fleet operator running many
+// simulators would ship to a log aggregator; console is for a human
+// watching one instance in a terminal.
+func New(level, format string) (*zap.Logger, error) {
+	var lvl zapcore.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("logging: invalid -logLevel %q: %w", level, err)
+	}
+
+	var cfg zap.Config
+	switch format {
+	case "json":
+		cfg = zap.NewProductionConfig()
+	case "console":
+		cfg = zap.NewDevelopmentConfig()
+	default:
+		return nil, fmt.Errorf("logging: invalid -logFormat %q (want console|json)", format)
+	}
+	cfg.Level = zap.NewAtomicLevelAt(lvl)
+
+	logger, err := cfg.Build()
+	if err != nil {
+		return nil, fmt.Errorf("logging: %w", err)
+	}
+	return logger, nil
+}
+
+// Field helpers keep key names consistent between the simulator and server.
+func DeviceID(v string) zap.Field     { return zap.String("device_id", v) }
+func SessionStart(v string) zap.Field { return zap.String("session_start", v) }
+func RunSeconds(v int) zap.Field      { return zap.Int("run_seconds", v) }
+func MsgID(v string) zap.Field        { return zap.String("msg_id", v) }
+func Attempt(v int) zap.Field         { return zap.Int("attempt", v) }
+func OutboxDepth(v int) zap.Field     { return zap.Int("outbox_depth", v) }
+
+// NewCorrelationID generates a short random id for request-scoped logging and
+// the X-Correlation-Id response header, so a client's retries of the same
+// logical request can be traced across its own logs and the server's.
+func NewCorrelationID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
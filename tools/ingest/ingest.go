@@ -0,0 +1,317 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"plane-tracker/internal/logging"
+	"plane-tracker/tools/types"
+)
+
+// maxBatchItems caps how many updates a single /ingest/batch request may
+// carry; larger batches get a 413 so the client negotiates its batch size
+// down instead of retrying the same oversized payload forever.
+const maxBatchItems = 256
+
+// errMonotonicity marks a rejection caused by run_seconds going backwards
+// within an open session, so handlers can tell it apart from other
+// validation failures and respond 409 instead of 400.
+var errMonotonicity = errors.New("run_seconds went backwards within session")
+
+// deviceState tracks what we've seen for one device, for the monotonicity
+// check and the /stats endpoint.
+type deviceState struct {
+	mu           sync.Mutex
+	sessionCount int
+	lastSeen     time.Time
+	sessions     map[string]int // session_start -> last run_seconds seen
+}
+
+// deviceStats is the /stats shape for one device.
+type deviceStats struct {
+	SessionCount int       `json:"session_count"`
+	LastSeen     time.Time `json:"last_seen"`
+}
+
+// deviceTracker holds per-device state across all in-flight requests.
+type deviceTracker struct {
+	mu      sync.Mutex
+	devices map[string]*deviceState
+}
+
+func newDeviceTracker() *deviceTracker {
+	return &deviceTracker{devices: make(map[string]*deviceState)}
+}
+
+// checkAndRecord rejects a non-duplicate update whose run_seconds is lower
+// than the high-water mark already recorded for the same device+session, and
+// otherwise records it and bumps the device's stats. Callers must dedup u
+// against the Store first: a retried or reordered redelivery of something
+// already seen acks as "dup" before ever reaching this check, so a rejection
+// here means a genuinely new update regressed run_seconds within an open
+// session.
+func (t *deviceTracker) checkAndRecord(u types.Update) error {
+	t.mu.Lock()
+	ds, ok := t.devices[u.DeviceID]
+	if !ok {
+		ds = &deviceState{sessions: make(map[string]int)}
+		t.devices[u.DeviceID] = ds
+	}
+	t.mu.Unlock()
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if last, known := ds.sessions[u.SessionStart]; !known {
+		ds.sessionCount++
+	} else if u.RunSeconds < last {
+		return fmt.Errorf("%w: session %s run_seconds %d -> %d", errMonotonicity, u.SessionStart, last, u.RunSeconds)
+	}
+	ds.sessions[u.SessionStart] = u.RunSeconds
+	ds.lastSeen = time.Now().UTC()
+	return nil
+}
+
+func (t *deviceTracker) snapshot() map[string]deviceStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make(map[string]deviceStats, len(t.devices))
+	for id, ds := range t.devices {
+		ds.mu.Lock()
+		out[id] = deviceStats{SessionCount: ds.sessionCount, LastSeen: ds.lastSeen}
+		ds.mu.Unlock()
+	}
+	return out
+}
+
+// batchEnvelope is the named-fields shape of an /ingest/batch request.
+type batchEnvelope struct {
+	DeviceID string         `json:"device_id"`
+	Updates  []types.Update `json:"updates"`
+}
+
+// itemResult is the per-update outcome reported back for a batch, and also
+// drives the single-item /ingest response.
+type itemResult struct {
+	MsgID  string `json:"msg_id"`
+	Status string `json:"status"` // "ok" | "dup" | "error"
+	Error  string `json:"error,omitempty"`
+}
+
+type batchResponse struct {
+	Results []itemResult `json:"results"`
+}
+
+// server holds the shared state behind the HTTP handlers.
+type server struct {
+	store   Store
+	tracker *deviceTracker
+	logger  *zap.Logger
+}
+
+// requestLogger assigns a correlation id to one request, sets it on the
+// response header so a client's retries can be traced end-to-end, and
+// returns a logger with it attached as a field.
+func (s *server) requestLogger(w http.ResponseWriter) *zap.Logger {
+	cid := logging.NewCorrelationID()
+	w.Header().Set("X-Correlation-Id", cid)
+	return s.logger.With(zap.String("correlation_id", cid))
+}
+
+// updateOutcome is processUpdate's result: result is the client-facing
+// status, httpStatus is only meaningful for the single-item /ingest path
+// (the batch endpoint always answers 200 and reports failures per item).
+type updateOutcome struct {
+	result     itemResult
+	httpStatus int
+}
+
+// processUpdate validates msg_id, dedups u against the Store, then checks
+// per-session monotonicity. It's shared by /ingest and /ingest/batch so both
+// endpoints apply exactly the same rules. Dedup runs first so a retried or
+// reordered redelivery of something already seen always acks as "dup"
+// instead of hitting the monotonicity check — store-and-forward guarantees
+// eventual delivery, not in-order delivery, of each distinct update. The
+// monotonicity check still rejects with 409 when a genuinely new update
+// regresses run_seconds within an open session.
+func (s *server) processUpdate(u types.Update) updateOutcome {
+	if want := u.SessionStart + ":" + strconv.Itoa(u.RunSeconds); u.MsgID != want {
+		return updateOutcome{
+			result:     itemResult{MsgID: u.MsgID, Status: "error", Error: fmt.Sprintf("msg_id %q does not match session_start:run_seconds (want %q)", u.MsgID, want)},
+			httpStatus: http.StatusBadRequest,
+		}
+	}
+	duplicate, err := s.store.SeenOrRecord(u.DeviceID, u.MsgID)
+	if err != nil {
+		return updateOutcome{result: itemResult{MsgID: u.MsgID, Status: "error", Error: err.Error()}, httpStatus: http.StatusInternalServerError}
+	}
+	if duplicate {
+		return updateOutcome{result: itemResult{MsgID: u.MsgID, Status: "dup"}, httpStatus: http.StatusOK}
+	}
+	if err := s.tracker.checkAndRecord(u); err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, errMonotonicity) {
+			status = http.StatusConflict
+		}
+		return updateOutcome{result: itemResult{MsgID: u.MsgID, Status: "error", Error: err.Error()}, httpStatus: status}
+	}
+	return updateOutcome{result: itemResult{MsgID: u.MsgID, Status: "ok"}, httpStatus: http.StatusOK}
+}
+
+func main() {
+	var (
+		addr          = flag.String("addr", ":8080", "Listen address")
+		storeBackend  = flag.String("storeBackend", "memory", "Dedup store backend: memory|bolt")
+		boltPath      = flag.String("boltPath", "ingest-store.db", "Path to the BoltDB file when -storeBackend=bolt")
+		storeTTL      = flag.Duration("storeTTL", 24*time.Hour, "How long a msg_id is remembered by the memory store")
+		storeMaxItems = flag.Int("storeMaxItems", 100000, "Max entries kept by the memory store (0 = unbounded)")
+		logLevel      = flag.String("logLevel", "info", "Log level: debug|info|warn|error")
+		logFormat     = flag.String("logFormat", "json", "Log format: console|json")
+	)
+	flag.Parse()
+
+	logger, err := logging.New(*logLevel, *logFormat)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer logger.Sync()
+
+	var store Store
+	switch *storeBackend {
+	case "memory":
+		store = NewMemoryStore(*storeTTL, *storeMaxItems)
+	case "bolt":
+		bolt, err := NewBoltStore(*boltPath)
+		if err != nil {
+			logger.Fatal("store", zap.Error(err))
+		}
+		defer bolt.Close()
+		store = bolt
+	default:
+		logger.Fatal("invalid -storeBackend", zap.String("storeBackend", *storeBackend))
+	}
+
+	s := &server{store: store, tracker: newDeviceTracker(), logger: logger}
+
+	http.HandleFunc("/ingest", s.handleIngest)
+	http.HandleFunc("/ingest/batch", s.handleIngestBatch)
+	http.HandleFunc("/stats", s.handleStats)
+
+	logger.Info("ingest server listening", zap.String("addr", *addr))
+	logger.Fatal("server exited", zap.Error(http.ListenAndServe(*addr, nil)))
+}
+
+func (s *server) handleIngest(w http.ResponseWriter, r *http.Request) {
+	logger := s.requestLogger(w)
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Error reading body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	var u types.Update
+	if err := json.Unmarshal(body, &u); err != nil {
+		http.Error(w, "Invalid update payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	logger = logger.With(logging.DeviceID(u.DeviceID), logging.SessionStart(u.SessionStart), logging.RunSeconds(u.RunSeconds), logging.MsgID(u.MsgID))
+
+	outcome := s.processUpdate(u)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(outcome.httpStatus)
+	if outcome.result.Status == "error" {
+		logger.Warn("ingest rejected", zap.String("error", outcome.result.Error))
+		json.NewEncoder(w).Encode(map[string]string{"error": outcome.result.Error})
+		return
+	}
+	logger.Debug("ingest acked", zap.String("status", outcome.result.Status))
+	json.NewEncoder(w).Encode(map[string]bool{
+		"acked":     true,
+		"duplicate": outcome.result.Status == "dup",
+	})
+}
+
+// handleIngestBatch accepts either {"device_id":...,"updates":[...]} or a
+// bare JSON array of updates, and acks each item individually so the client
+// can ack partial successes without losing the rest of the queue.
+func (s *server) handleIngestBatch(w http.ResponseWriter, r *http.Request) {
+	logger := s.requestLogger(w)
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Error reading body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	updates, err := decodeBatch(body)
+	if err != nil {
+		http.Error(w, "Invalid batch payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(updates) > maxBatchItems {
+		logger.Warn("batch too large", zap.Int("items", len(updates)), zap.Int("max", maxBatchItems))
+		http.Error(w, fmt.Sprintf("batch too large: %d items (max %d)", len(updates), maxBatchItems), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	results := make([]itemResult, 0, len(updates))
+	failed := 0
+	for _, u := range updates {
+		outcome := s.processUpdate(u)
+		if outcome.result.Status == "error" {
+			failed++
+		}
+		results = append(results, outcome.result)
+	}
+	logger.Debug("batch processed", zap.Int("items", len(updates)), zap.Int("failed", failed))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(batchResponse{Results: results})
+}
+
+// handleStats reports per-device session counts and last-seen timestamps.
+func (s *server) handleStats(w http.ResponseWriter, r *http.Request) {
+	s.requestLogger(w)
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]map[string]deviceStats{
+		"devices": s.tracker.snapshot(),
+	})
+}
+
+// decodeBatch accepts either {"device_id":...,"updates":[...]} or a bare
+// JSON array of updates.
+func decodeBatch(body []byte) ([]types.Update, error) {
+	var env batchEnvelope
+	if err := json.Unmarshal(body, &env); err == nil && len(env.Updates) > 0 {
+		return env.Updates, nil
+	}
+	var arr []types.Update
+	if err := json.Unmarshal(body, &arr); err == nil {
+		return arr, nil
+	}
+	return nil, fmt.Errorf(`expected {"updates":[...]} or a JSON array`)
+}
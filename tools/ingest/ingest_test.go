@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"plane-tracker/tools/types"
+)
+
+func newTestServer() *server {
+	return &server{
+		store:   NewMemoryStore(time.Hour, 0),
+		tracker: newDeviceTracker(),
+		logger:  zap.NewNop(),
+	}
+}
+
+func update(sessionStart string, runSeconds int) types.Update {
+	return types.Update{
+		DeviceID:     "dev-1",
+		SessionStart: sessionStart,
+		RunSeconds:   runSeconds,
+		MsgID:        sessionStart + ":" + strconv.Itoa(runSeconds),
+	}
+}
+
+func TestProcessUpdateRetriedDuplicateAcksInsteadOf409(t *testing.T) {
+	s := newTestServer()
+	first := update("2026-01-01T00:00:00Z", 120)
+
+	if out := s.processUpdate(first); out.result.Status != "ok" {
+		t.Fatalf("first delivery status = %q, want ok", out.result.Status)
+	}
+
+	// The same update is retried by the client (e.g. the ack was lost in
+	// transit). It must ack as a duplicate, not be rejected for regressing
+	// run_seconds against itself.
+	out := s.processUpdate(first)
+	if out.httpStatus != http.StatusOK || out.result.Status != "dup" {
+		t.Fatalf("retried duplicate = %+v, want 200/dup", out)
+	}
+}
+
+func TestProcessUpdateGenuineRegressionRejectedWith409(t *testing.T) {
+	s := newTestServer()
+	session := "2026-01-01T00:00:00Z"
+
+	if out := s.processUpdate(update(session, 120)); out.result.Status != "ok" {
+		t.Fatalf("first delivery status = %q, want ok", out.result.Status)
+	}
+
+	// A distinct, never-before-seen update for the same session reports a
+	// lower run_seconds than one already recorded: a genuine regression, not
+	// a retry or reorder of the same item, so it must still 409.
+	out := s.processUpdate(update(session, 60))
+	if out.httpStatus != http.StatusConflict {
+		t.Fatalf("regression httpStatus = %d, want %d", out.httpStatus, http.StatusConflict)
+	}
+	if out.result.Status != "error" {
+		t.Fatalf("regression status = %q, want error", out.result.Status)
+	}
+}
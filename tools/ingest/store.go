@@ -0,0 +1,129 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// Store deduplicates update deliveries by msg_id, so outbox retries that
+// land after the original request already succeeded don't get double
+// counted by anything downstream of /ingest.
+type Store interface {
+	// SeenOrRecord reports whether (deviceID, msgID) has already been
+	// recorded, recording it if this is the first time it's seen.
+	SeenOrRecord(deviceID, msgID string) (duplicate bool, err error)
+}
+
+type memoryStoreEntry struct {
+	key       string
+	expiresAt time.Time
+}
+
+// MemoryStore is an in-process LRU+TTL dedup set. Entries older than ttl are
+// treated as not-seen on next lookup; maxItems bounds memory use by evicting
+// the least recently touched entry once the set is full.
+type MemoryStore struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	maxItems int
+	index    map[string]*list.Element
+	order    *list.List // front = most recently touched
+}
+
+var _ Store = (*MemoryStore)(nil)
+
+// NewMemoryStore builds a MemoryStore. maxItems <= 0 means unbounded.
+func NewMemoryStore(ttl time.Duration, maxItems int) *MemoryStore {
+	return &MemoryStore{
+		ttl:      ttl,
+		maxItems: maxItems,
+		index:    make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+func (s *MemoryStore) SeenOrRecord(deviceID, msgID string) (bool, error) {
+	key := deviceID + "/" + msgID
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if el, ok := s.index[key]; ok {
+		entry := el.Value.(*memoryStoreEntry)
+		if entry.expiresAt.After(now) {
+			s.order.MoveToFront(el)
+			return true, nil
+		}
+		s.order.Remove(el)
+		delete(s.index, key)
+	}
+
+	el := s.order.PushFront(&memoryStoreEntry{key: key, expiresAt: now.Add(s.ttl)})
+	s.index[key] = el
+	s.evictLocked()
+	return false, nil
+}
+
+func (s *MemoryStore) evictLocked() {
+	for s.maxItems > 0 && s.order.Len() > s.maxItems {
+		back := s.order.Back()
+		if back == nil {
+			return
+		}
+		entry := back.Value.(*memoryStoreEntry)
+		delete(s.index, entry.key)
+		s.order.Remove(back)
+	}
+}
+
+var seenBucket = []byte("seen_msg_ids")
+
+// BoltStore persists the dedup set to a BoltDB file so it survives server
+// restarts, at the cost of an fsync per SeenOrRecord call.
+type BoltStore struct {
+	db *bbolt.DB
+}
+
+var _ Store = (*BoltStore)(nil)
+
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bbolt.Open(path, 0o600, &bbolt.Options{Timeout: 2 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("store: open bolt db %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(seenBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("store: init bucket: %w", err)
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func (s *BoltStore) SeenOrRecord(deviceID, msgID string) (bool, error) {
+	key := []byte(deviceID + "/" + msgID)
+	duplicate := false
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(seenBucket)
+		if b.Get(key) != nil {
+			duplicate = true
+			return nil
+		}
+		return b.Put(key, []byte(time.Now().UTC().Format(time.RFC3339)))
+	})
+	if err != nil {
+		return false, fmt.Errorf("store: bolt update: %w", err)
+	}
+	return duplicate, nil
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreSeenOrRecordDedup(t *testing.T) {
+	s := NewMemoryStore(time.Hour, 0)
+
+	dup, err := s.SeenOrRecord("dev-1", "session:1")
+	if err != nil {
+		t.Fatalf("SeenOrRecord (first): %v", err)
+	}
+	if dup {
+		t.Fatal("first SeenOrRecord reported duplicate, want false")
+	}
+
+	dup, err = s.SeenOrRecord("dev-1", "session:1")
+	if err != nil {
+		t.Fatalf("SeenOrRecord (repeat): %v", err)
+	}
+	if !dup {
+		t.Fatal("repeat SeenOrRecord reported not-duplicate, want true")
+	}
+
+	// A different device using the same msg_id is a distinct key.
+	dup, err = s.SeenOrRecord("dev-2", "session:1")
+	if err != nil {
+		t.Fatalf("SeenOrRecord (other device): %v", err)
+	}
+	if dup {
+		t.Fatal("SeenOrRecord for a different device reported duplicate, want false")
+	}
+}
+
+func TestMemoryStoreSeenOrRecordTTLExpiry(t *testing.T) {
+	s := NewMemoryStore(time.Millisecond, 0)
+
+	if _, err := s.SeenOrRecord("dev-1", "session:1"); err != nil {
+		t.Fatalf("SeenOrRecord (first): %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	dup, err := s.SeenOrRecord("dev-1", "session:1")
+	if err != nil {
+		t.Fatalf("SeenOrRecord (after ttl): %v", err)
+	}
+	if dup {
+		t.Fatal("SeenOrRecord reported duplicate after ttl expiry, want false")
+	}
+}
+
+func TestBoltStoreSeenOrRecordDedup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.db")
+	s, err := NewBoltStore(path)
+	if err != nil {
+		t.Fatalf("NewBoltStore: %v", err)
+	}
+	defer s.Close()
+
+	dup, err := s.SeenOrRecord("dev-1", "session:1")
+	if err != nil {
+		t.Fatalf("SeenOrRecord (first): %v", err)
+	}
+	if dup {
+		t.Fatal("first SeenOrRecord reported duplicate, want false")
+	}
+
+	dup, err = s.SeenOrRecord("dev-1", "session:1")
+	if err != nil {
+		t.Fatalf("SeenOrRecord (repeat): %v", err)
+	}
+	if !dup {
+		t.Fatal("repeat SeenOrRecord reported not-duplicate, want true")
+	}
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// walRecordKind distinguishes the two kinds of records appended to the
+// outbox WAL.
+type walRecordKind string
+
+const (
+	walEnqueue    walRecordKind = "enqueue"
+	walAck        walRecordKind = "ack"        // tombstone: msg_ids that were sent successfully
+	walDeadLetter walRecordKind = "deadletter" // tombstone: msg_ids given up on after too many attempts
+)
+
+// walRecord is the length-prefixed JSON unit written to outbox.log.
+type walRecord struct {
+	Kind   walRecordKind `json:"kind"`
+	Update *Update       `json:"update,omitempty"`
+	MsgIDs []string      `json:"msg_ids,omitempty"`
+}
+
+// DurableOutbox is an OutboxStore backed by a WAL file (outbox.log) inside
+// Dir, so queued updates survive a crash or reboot of the device this
+// simulates — the in-memory Outbox alone can't make that promise. Enqueue
+// appends a record before it is considered queued; AckSelective appends a
+// tombstone record rather than rewriting history. On startup the log is
+// replayed to rebuild the live queue, skipping any msg_id covered by a
+// later tombstone.
+type DurableOutbox struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+	w    *bufio.Writer
+
+	q    []*outboxEntry
+	dead []*Update
+	sent int
+
+	maxBytes   int64
+	written    int64
+	fsyncEvery time.Duration
+	lastFsync  time.Time
+}
+
+var _ OutboxStore = (*DurableOutbox)(nil)
+
+// NewDurableOutbox opens (creating if needed) the WAL at <dir>/outbox.log,
+// replays it to rebuild the in-memory queue, compacts it if it has already
+// grown past maxBytes, and leaves it open for appending. fsyncEvery <= 0
+// fsyncs after every write; otherwise fsync happens at most that often.
+func NewDurableOutbox(dir string, maxBytes int64, fsyncEvery time.Duration) (*DurableOutbox, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("outbox: create dir %s: %w", dir, err)
+	}
+	o := &DurableOutbox{
+		path:       filepath.Join(dir, "outbox.log"),
+		maxBytes:   maxBytes,
+		fsyncEvery: fsyncEvery,
+	}
+	if err := o.replay(); err != nil {
+		return nil, fmt.Errorf("outbox: replay %s: %w", o.path, err)
+	}
+	// replay stops at the first torn/corrupt record but leaves any bytes after
+	// it on disk; truncate them away now so appending doesn't pile new
+	// records on top of garbage that would again stop the reader (and hide
+	// everything after it) on the next replay.
+	if err := os.Truncate(o.path, o.written); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("outbox: truncate %s to %d: %w", o.path, o.written, err)
+	}
+	if o.maxBytes > 0 && o.written > o.maxBytes {
+		if err := o.compactLocked(); err != nil {
+			return nil, fmt.Errorf("outbox: initial compaction: %w", err)
+		}
+	} else if err := o.openForAppendLocked(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// replay reconstructs the live queue from the WAL: entries are applied in
+// order, then anything whose msg_id is covered by a later "ack" or
+// "deadletter" tombstone is dropped (into the sent count or the dead-letter
+// list respectively). A corrupt or truncated tail record is treated as the
+// end of the log rather than a fatal error. Retry bookkeeping (attempts,
+// nextAttempt) is not persisted, so replayed items start fresh and are
+// immediately eligible for another attempt.
+func (o *DurableOutbox) replay() error {
+	records, validBytes, err := readWAL(o.path)
+	if err != nil {
+		return err
+	}
+	tomb := make(map[string]bool)
+	deadIDs := make(map[string]bool)
+	var q []*Update
+	for _, rec := range records {
+		switch rec.Kind {
+		case walEnqueue:
+			if rec.Update != nil {
+				q = append(q, rec.Update)
+			}
+		case walAck:
+			for _, id := range rec.MsgIDs {
+				tomb[id] = true
+			}
+		case walDeadLetter:
+			for _, id := range rec.MsgIDs {
+				deadIDs[id] = true
+			}
+		}
+	}
+	var live []*outboxEntry
+	var dead []*Update
+	sent := 0
+	for _, u := range q {
+		switch {
+		case tomb[u.MsgID]:
+			sent++
+		case deadIDs[u.MsgID]:
+			dead = append(dead, u)
+		default:
+			live = append(live, &outboxEntry{update: u})
+		}
+	}
+	o.q = live
+	o.dead = dead
+	o.sent = sent
+	o.written = validBytes
+	return nil
+}
+
+// readWAL reads every complete, well-formed record from path. It stops at
+// the first record it cannot fully decode (partial header, truncated body,
+// or invalid JSON) instead of panicking, on the assumption that a torn
+// write was interrupted by a crash and anything after it was never fsynced.
+// It returns the records read and the number of bytes that made up valid
+// records (i.e. the length to truncate to on compaction/recovery).
+func readWAL(path string) ([]walRecord, int64, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	var records []walRecord
+	var validBytes int64
+	r := bufio.NewReader(f)
+	for {
+		var hdr [4]byte
+		n, err := io.ReadFull(r, hdr[:])
+		if n == 0 && err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("[outbox] truncated record header at offset %d, stopping replay: %v", validBytes, err)
+			break
+		}
+		length := binary.BigEndian.Uint32(hdr[:])
+		body := make([]byte, length)
+		if _, err := io.ReadFull(r, body); err != nil {
+			log.Printf("[outbox] truncated record body at offset %d, stopping replay: %v", validBytes, err)
+			break
+		}
+		var rec walRecord
+		if err := json.Unmarshal(body, &rec); err != nil {
+			log.Printf("[outbox] corrupt record at offset %d, stopping replay: %v", validBytes, err)
+			break
+		}
+		validBytes += int64(len(hdr)) + int64(length)
+		records = append(records, rec)
+	}
+	return records, validBytes, nil
+}
+
+// openForAppendLocked (re)opens the WAL file for appending. Callers must
+// hold o.mu.
+func (o *DurableOutbox) openForAppendLocked() error {
+	if o.f != nil {
+		o.w.Flush()
+		o.f.Close()
+	}
+	f, err := os.OpenFile(o.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("outbox: open %s: %w", o.path, err)
+	}
+	o.f = f
+	o.w = bufio.NewWriter(f)
+	return nil
+}
+
+// appendLocked writes one length-prefixed record and flushes it to the OS
+// (but does not necessarily fsync — see maybeFsyncLocked). Callers must
+// hold o.mu.
+func (o *DurableOutbox) appendLocked(rec walRecord) (int64, error) {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return 0, err
+	}
+	var hdr [4]byte
+	binary.BigEndian.PutUint32(hdr[:], uint32(len(b)))
+	if _, err := o.w.Write(hdr[:]); err != nil {
+		return 0, err
+	}
+	if _, err := o.w.Write(b); err != nil {
+		return 0, err
+	}
+	if err := o.w.Flush(); err != nil {
+		return 0, err
+	}
+	return int64(len(hdr)) + int64(len(b)), nil
+}
+
+// maybeFsyncLocked fsyncs the WAL if fsyncEvery has elapsed since the last
+// fsync (or immediately, if fsyncEvery <= 0). Callers must hold o.mu.
+func (o *DurableOutbox) maybeFsyncLocked() error {
+	if o.fsyncEvery > 0 && time.Since(o.lastFsync) < o.fsyncEvery {
+		return nil
+	}
+	if err := o.f.Sync(); err != nil {
+		return err
+	}
+	o.lastFsync = time.Now()
+	return nil
+}
+
+// compactLocked rewrites the WAL from scratch containing only the live
+// queue, then reopens the append handle against the new file. Callers must
+// hold o.mu.
+func (o *DurableOutbox) compactLocked() error {
+	tmpPath := o.path + ".compact.tmp"
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("outbox: create compaction file: %w", err)
+	}
+	w := bufio.NewWriter(f)
+	var written int64
+	for _, e := range o.q {
+		b, err := json.Marshal(walRecord{Kind: walEnqueue, Update: e.update})
+		if err != nil {
+			f.Close()
+			return err
+		}
+		var hdr [4]byte
+		binary.BigEndian.PutUint32(hdr[:], uint32(len(b)))
+		if _, err := w.Write(hdr[:]); err != nil {
+			f.Close()
+			return err
+		}
+		if _, err := w.Write(b); err != nil {
+			f.Close()
+			return err
+		}
+		written += int64(len(hdr)) + int64(len(b))
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, o.path); err != nil {
+		return fmt.Errorf("outbox: replace WAL with compacted copy: %w", err)
+	}
+	o.written = written
+	return o.openForAppendLocked()
+}
+
+// compactIfOverLocked compacts if the WAL has grown past maxBytes. Callers
+// must hold o.mu.
+func (o *DurableOutbox) compactIfOverLocked() {
+	if o.maxBytes <= 0 || o.written <= o.maxBytes {
+		return
+	}
+	if err := o.compactLocked(); err != nil {
+		log.Printf("[outbox] compaction failed, continuing with uncompacted WAL: %v", err)
+	}
+}
+
+func (o *DurableOutbox) Enqueue(u *Update) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	n, err := o.appendLocked(walRecord{Kind: walEnqueue, Update: u})
+	if err != nil {
+		return fmt.Errorf("outbox: enqueue: %w", err)
+	}
+	o.written += n
+	o.q = append(o.q, &outboxEntry{update: u})
+	if err := o.maybeFsyncLocked(); err != nil {
+		log.Printf("[outbox] fsync failed after enqueue: %v", err)
+	}
+	o.compactIfOverLocked()
+	return nil
+}
+
+func (o *DurableOutbox) PeekBatch(max int) []*Update {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	now := time.Now()
+	var b []*Update
+	for _, e := range o.q {
+		if len(b) >= max {
+			break
+		}
+		if e.nextAttempt.After(now) {
+			continue
+		}
+		b = append(b, e.update)
+	}
+	return b
+}
+
+// AckSelective appends a tombstone record for msgIDs, then removes any
+// matching entries from the live queue regardless of position.
+func (o *DurableOutbox) AckSelective(msgIDs []string) int {
+	if len(msgIDs) == 0 {
+		return 0
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	n, err := o.appendLocked(walRecord{Kind: walAck, MsgIDs: msgIDs})
+	if err != nil {
+		log.Printf("[outbox] failed to write ack tombstone, leaving items queued: %v", err)
+		return 0
+	}
+	o.written += n
+
+	acked := make(map[string]bool, len(msgIDs))
+	for _, id := range msgIDs {
+		acked[id] = true
+	}
+	kept := o.q[:0]
+	removed := 0
+	for _, e := range o.q {
+		if acked[e.update.MsgID] {
+			removed++
+			continue
+		}
+		kept = append(kept, e)
+	}
+	o.q = kept
+	o.sent += removed
+
+	if err := o.maybeFsyncLocked(); err != nil {
+		log.Printf("[outbox] fsync failed after ack: %v", err)
+	}
+	o.compactIfOverLocked()
+	return removed
+}
+
+// MarkFailed bumps the retry count for msgIDs, schedules their next attempt
+// with backoff, and moves anything past maxAttempts to the dead-letter list
+// (recorded as a WAL tombstone so it isn't replayed as live on restart).
+func (o *DurableOutbox) MarkFailed(msgIDs []string, base, max time.Duration, maxAttempts int) []string {
+	if len(msgIDs) == 0 {
+		return nil
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	failed := make(map[string]bool, len(msgIDs))
+	for _, id := range msgIDs {
+		failed[id] = true
+	}
+
+	now := time.Now()
+	var deadLettered []string
+	kept := o.q[:0]
+	for _, e := range o.q {
+		if failed[e.update.MsgID] {
+			e.attempts++
+			if maxAttempts > 0 && e.attempts > maxAttempts {
+				o.dead = append(o.dead, e.update)
+				deadLettered = append(deadLettered, e.update.MsgID)
+				continue
+			}
+			e.nextAttempt = now.Add(backoffDuration(base, max, e.attempts))
+		}
+		kept = append(kept, e)
+	}
+	o.q = kept
+
+	if len(deadLettered) == 0 {
+		return nil
+	}
+	n, err := o.appendLocked(walRecord{Kind: walDeadLetter, MsgIDs: deadLettered})
+	if err != nil {
+		log.Printf("[outbox] failed to write dead-letter tombstone: %v", err)
+		return deadLettered
+	}
+	o.written += n
+	if err := o.maybeFsyncLocked(); err != nil {
+		log.Printf("[outbox] fsync failed after dead-letter: %v", err)
+	}
+	o.compactIfOverLocked()
+	return deadLettered
+}
+
+func (o *DurableOutbox) DeadLetter() []*Update {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	out := make([]*Update, len(o.dead))
+	copy(out, o.dead)
+	return out
+}
+
+func (o *DurableOutbox) Len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.q)
+}
+
+func (o *DurableOutbox) Sent() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.sent
+}
+
+// Close flushes and fsyncs the WAL and closes the underlying file.
+func (o *DurableOutbox) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.f == nil {
+		return nil
+	}
+	if err := o.w.Flush(); err != nil {
+		return err
+	}
+	if err := o.f.Sync(); err != nil {
+		return err
+	}
+	return o.f.Close()
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Outcome classifies a single POST attempt for reporting purposes.
+type Outcome string
+
+const (
+	OutcomeSuccess       Outcome = "2xx"
+	OutcomeSimulatedFail Outcome = "simulated-failure"
+	OutcomeNetworkError  Outcome = "network-error"
+	OutcomeQueuedOffline Outcome = "queued-offline"
+)
+
+// allOutcomes fixes the iteration/index order used by Metrics' counters.
+var allOutcomes = []Outcome{OutcomeSuccess, OutcomeSimulatedFail, OutcomeNetworkError, OutcomeQueuedOffline}
+
+func outcomeIndex(o Outcome) int {
+	for i, oc := range allOutcomes {
+		if oc == o {
+			return i
+		}
+	}
+	return -1
+}
+
+// ringCapacity bounds how many latency samples are kept for percentile
+// computation; older samples are overwritten as new ones arrive.
+const ringCapacity = 1 << 16
+
+// Metrics records every POST attempt's latency and outcome. Durations are
+// stored in a fixed-size ring buffer addressed by an ever-incrementing
+// atomic cursor, so concurrent Record calls never block each other or a
+// concurrent Snapshot.
+type Metrics struct {
+	head        uint64 // atomic: slots written so far; the slot index is head mod ringCapacity
+	durationsNS []int64
+
+	counts []int64 // atomic per-outcome totals, unbounded by ring size
+
+	peakDepth int64 // atomic
+	startedAt time.Time
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		durationsNS: make([]int64, ringCapacity),
+		counts:      make([]int64, len(allOutcomes)),
+		startedAt:   time.Now(),
+	}
+}
+
+// Record logs one POST attempt. Outcome-only samples (queued-offline, where
+// no network call was made) don't contribute a latency sample.
+func (m *Metrics) Record(d time.Duration, outcome Outcome, queueDepth int) {
+	idx := outcomeIndex(outcome)
+	if idx < 0 {
+		return
+	}
+	atomic.AddInt64(&m.counts[idx], 1)
+	if outcome != OutcomeQueuedOffline {
+		slot := atomic.AddUint64(&m.head, 1) - 1
+		atomic.StoreInt64(&m.durationsNS[slot%ringCapacity], int64(d))
+	}
+	for {
+		old := atomic.LoadInt64(&m.peakDepth)
+		if int64(queueDepth) <= old {
+			return
+		}
+		if atomic.CompareAndSwapInt64(&m.peakDepth, old, int64(queueDepth)) {
+			return
+		}
+	}
+}
+
+// HistBucket is one bin of the latency histogram.
+type HistBucket struct {
+	LowMS  float64 `json:"low_ms"`
+	HighMS float64 `json:"high_ms"`
+	Count  int     `json:"count"`
+}
+
+// Report is a point-in-time snapshot, safe to print or marshal to JSON.
+type Report struct {
+	DurationSec      float64          `json:"duration_sec"`
+	Counts           map[string]int64 `json:"counts"`
+	MinMS            float64          `json:"min_ms"`
+	AvgMS            float64          `json:"avg_ms"`
+	P50MS            float64          `json:"p50_ms"`
+	P90MS            float64          `json:"p90_ms"`
+	P99MS            float64          `json:"p99_ms"`
+	MaxMS            float64          `json:"max_ms"`
+	ThroughputPerSec float64          `json:"throughput_per_sec"`
+	CurrentDepth     int              `json:"current_outbox_depth"`
+	PeakDepth        int64            `json:"peak_outbox_depth"`
+	Histogram        []HistBucket     `json:"latency_histogram_ms"`
+}
+
+// Snapshot computes a Report from the samples recorded so far. currentDepth
+// is supplied by the caller since the outbox, not Metrics, owns it.
+func (m *Metrics) Snapshot(currentDepth int) Report {
+	head := atomic.LoadUint64(&m.head)
+	n := head
+	if n > ringCapacity {
+		n = ringCapacity
+	}
+	durs := make([]float64, 0, n)
+	for i := uint64(0); i < n; i++ {
+		durs = append(durs, float64(atomic.LoadInt64(&m.durationsNS[i]))/1e6)
+	}
+	sort.Float64s(durs)
+
+	counts := make(map[string]int64, len(allOutcomes))
+	for i, oc := range allOutcomes {
+		counts[string(oc)] = atomic.LoadInt64(&m.counts[i])
+	}
+
+	rep := Report{
+		DurationSec:      time.Since(m.startedAt).Seconds(),
+		Counts:           counts,
+		ThroughputPerSec: 0,
+		CurrentDepth:     currentDepth,
+		PeakDepth:        atomic.LoadInt64(&m.peakDepth),
+	}
+	if rep.DurationSec > 0 {
+		rep.ThroughputPerSec = float64(counts[string(OutcomeSuccess)]) / rep.DurationSec
+	}
+	if len(durs) == 0 {
+		return rep
+	}
+	rep.MinMS = durs[0]
+	rep.MaxMS = durs[len(durs)-1]
+	rep.AvgMS = mean(durs)
+	rep.P50MS = percentile(durs, 0.50)
+	rep.P90MS = percentile(durs, 0.90)
+	rep.P99MS = percentile(durs, 0.99)
+	rep.Histogram = histogram(durs, 10)
+	return rep
+}
+
+func mean(sorted []float64) float64 {
+	var sum float64
+	for _, v := range sorted {
+		sum += v
+	}
+	return sum / float64(len(sorted))
+}
+
+// percentile expects sorted ascending input.
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 1 {
+		return sorted[0]
+	}
+	idx := int(p * float64(len(sorted)-1))
+	return sorted[idx]
+}
+
+// histogram buckets sorted latencies into `bins` equal-width bins spanning
+// [min, max].
+func histogram(sorted []float64, bins int) []HistBucket {
+	lo, hi := sorted[0], sorted[len(sorted)-1]
+	if hi == lo {
+		return []HistBucket{{LowMS: lo, HighMS: hi, Count: len(sorted)}}
+	}
+	width := (hi - lo) / float64(bins)
+	buckets := make([]HistBucket, bins)
+	for i := range buckets {
+		buckets[i] = HistBucket{LowMS: lo + width*float64(i), HighMS: lo + width*float64(i+1)}
+	}
+	for _, v := range sorted {
+		idx := int((v - lo) / width)
+		if idx >= bins {
+			idx = bins - 1
+		}
+		buckets[idx].Count++
+	}
+	return buckets
+}
+
+// WriteText prints the benchmark-tool-style report: counts per outcome,
+// latency percentiles, throughput, outbox depth, and an ASCII histogram.
+func (r Report) WriteText(w io.Writer) {
+	fmt.Fprintf(w, "==== simulator metrics (%.1fs) ====\n", r.DurationSec)
+	for _, oc := range allOutcomes {
+		fmt.Fprintf(w, "  %-18s %d\n", oc, r.Counts[string(oc)])
+	}
+	fmt.Fprintf(w, "latency ms:  min=%.1f  avg=%.1f  p50=%.1f  p90=%.1f  p99=%.1f  max=%.1f\n",
+		r.MinMS, r.AvgMS, r.P50MS, r.P90MS, r.P99MS, r.MaxMS)
+	fmt.Fprintf(w, "throughput:  %.2f sent/sec\n", r.ThroughputPerSec)
+	fmt.Fprintf(w, "outbox depth: current=%d peak=%d\n", r.CurrentDepth, r.PeakDepth)
+	if len(r.Histogram) == 0 {
+		return
+	}
+	maxCount := 0
+	for _, b := range r.Histogram {
+		if b.Count > maxCount {
+			maxCount = b.Count
+		}
+	}
+	fmt.Fprintln(w, "latency histogram (ms):")
+	for _, b := range r.Histogram {
+		barLen := 0
+		if maxCount > 0 {
+			barLen = b.Count * 40 / maxCount
+		}
+		fmt.Fprintf(w, "  [%7.1f, %7.1f) %6d %s\n", b.LowMS, b.HighMS, b.Count, strings.Repeat("#", barLen))
+	}
+}
+
+// WriteJSON writes the report to path so separate simulator runs can be
+// diffed in CI to catch regressions in the store-and-forward logic.
+func (r Report) WriteJSON(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("metrics: create %s: %w", path, err)
+	}
+	defer f.Close()
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// OutboxStore is the store-and-forward queue behind the flush loop. Outbox
+// is the plain in-memory implementation used by default and in tests;
+// DurableOutbox backs the same interface with a WAL so queued updates
+// survive a crash or reboot of the device this simulates.
+type OutboxStore interface {
+	Enqueue(u *Update) error
+	// PeekBatch returns up to max queued items whose next retry is due.
+	PeekBatch(max int) []*Update
+	AckSelective(msgIDs []string) int
+	// MarkFailed bumps the retry count for msgIDs and schedules their next
+	// attempt with exponential backoff (base*2^attempts, capped at max,
+	// with jitter). Items that exceed maxAttempts are moved to the
+	// dead-letter list instead, and their msg_ids are returned.
+	MarkFailed(msgIDs []string, base, max time.Duration, maxAttempts int) (deadLettered []string)
+	DeadLetter() []*Update
+	Len() int
+	Sent() int
+}
+
+// outboxEntry pairs a queued update with its retry bookkeeping.
+type outboxEntry struct {
+	update      *Update
+	attempts    int
+	nextAttempt time.Time // zero value means "due immediately"
+}
+
+// backoffDuration computes how long to wait before the next attempt for an
+// item that has now failed `attempts` times: base*2^attempts, capped at max,
+// with up to ±25% jitter so a batch of items that failed together doesn't
+// retry in lockstep.
+func backoffDuration(base, max time.Duration, attempts int) time.Duration {
+	if base <= 0 {
+		return 0
+	}
+	shift := attempts
+	if shift > 30 { // guard against overflow for pathological attempt counts
+		shift = 30
+	}
+	d := base * time.Duration(int64(1)<<uint(shift))
+	if max > 0 && d > max {
+		d = max
+	}
+	jitter := time.Duration(rand.Int63n(int64(d)/2+1)) - d/4
+	d += jitter
+	if d < 0 {
+		d = 0
+	}
+	return d
+}
+
+// Outbox is a simple queue held only in memory; its contents are lost on
+// restart. Due items are retried oldest-first; an item leaves the queue when
+// it is acked or when MarkFailed moves it to the dead-letter list.
+type Outbox struct {
+	mu   sync.Mutex
+	q    []*outboxEntry
+	dead []*Update
+	sent int // total sent successfully (metrics)
+}
+
+var _ OutboxStore = (*Outbox)(nil)
+
+func (o *Outbox) Enqueue(u *Update) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.q = append(o.q, &outboxEntry{update: u})
+	return nil
+}
+
+func (o *Outbox) PeekBatch(max int) []*Update {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	now := time.Now()
+	var b []*Update
+	for _, e := range o.q {
+		if len(b) >= max {
+			break
+		}
+		if e.nextAttempt.After(now) {
+			continue
+		}
+		b = append(b, e.update)
+	}
+	return b
+}
+
+// AckSelective removes queued items whose MsgID appears in msgIDs, regardless
+// of position, and returns how many were removed. A batch flush can come
+// back with a mix of "ok"/"dup"/"error" results and we only want to drop the
+// ones that made it through.
+func (o *Outbox) AckSelective(msgIDs []string) int {
+	if len(msgIDs) == 0 {
+		return 0
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	acked := make(map[string]bool, len(msgIDs))
+	for _, id := range msgIDs {
+		acked[id] = true
+	}
+	kept := o.q[:0]
+	n := 0
+	for _, e := range o.q {
+		if acked[e.update.MsgID] {
+			n++
+			continue
+		}
+		kept = append(kept, e)
+	}
+	o.q = kept
+	o.sent += n
+	return n
+}
+
+func (o *Outbox) MarkFailed(msgIDs []string, base, max time.Duration, maxAttempts int) []string {
+	if len(msgIDs) == 0 {
+		return nil
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	failed := make(map[string]bool, len(msgIDs))
+	for _, id := range msgIDs {
+		failed[id] = true
+	}
+	now := time.Now()
+	var deadLettered []string
+	kept := o.q[:0]
+	for _, e := range o.q {
+		if failed[e.update.MsgID] {
+			e.attempts++
+			if maxAttempts > 0 && e.attempts > maxAttempts {
+				o.dead = append(o.dead, e.update)
+				deadLettered = append(deadLettered, e.update.MsgID)
+				continue
+			}
+			e.nextAttempt = now.Add(backoffDuration(base, max, e.attempts))
+		}
+		kept = append(kept, e)
+	}
+	o.q = kept
+	return deadLettered
+}
+
+func (o *Outbox) DeadLetter() []*Update {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	out := make([]*Update, len(o.dead))
+	copy(out, o.dead)
+	return out
+}
+
+func (o *Outbox) Len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.q)
+}
+
+func (o *Outbox) Sent() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.sent
+}
@@ -0,0 +1,527 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+
+	"plane-tracker/internal/logging"
+)
+
+/*
+Simulates an ESP32 device that:
+- Creates random sessions (one per boot)
+- In each session, increments run_seconds at a fixed "device minute" interval
+- Sends JSON updates to a server endpoint
+- Store-and-forward: if offline or POST fails, queues and retries oldest-first
+- Idempotency via msg_id = session_start:run_seconds
+
+JSON payload sent:
+{
+  "device_id":     "car-esp32-01",
+  "session_start": "2025-10-23T18:00:00Z",
+  "run_seconds":   1200,
+  "last_update":   "2025-10-23T18:20:00Z",
+  "status":        "open" | "closed",
+  "msg_id":        "2025-10-23T18:00:00Z:1200"
+}
+*/
+
+type Update struct {
+	DeviceID     string `json:"device_id"`
+	SessionStart string `json:"session_start"`
+	RunSeconds   int    `json:"run_seconds"`
+	LastUpdate   string `json:"last_update"`
+	Status       string `json:"status"`
+	MsgID        string `json:"msg_id"`
+}
+
+// batchRequest is the body posted to /ingest/batch.
+type batchRequest struct {
+	DeviceID string    `json:"device_id"`
+	Updates  []*Update `json:"updates"`
+}
+
+// itemResult is the per-update outcome the server reports back for a batch.
+type itemResult struct {
+	MsgID  string `json:"msg_id"`
+	Status string `json:"status"` // "ok" | "dup" | "error"
+	Error  string `json:"error,omitempty"`
+}
+
+type batchResponse struct {
+	Results []itemResult `json:"results"`
+}
+
+// errSimulatedFailure marks a locally-faked server failure (serverErrProb),
+// so callers can tell it apart from a real network error or bad status for
+// metrics purposes.
+var errSimulatedFailure = errors.New("simulated server failure")
+
+// classifyPostErr maps a postOnce/postBatch error to the Outcome bucket it
+// belongs to for metrics reporting.
+func classifyPostErr(err error) Outcome {
+	if err == nil {
+		return OutcomeSuccess
+	}
+	if errors.Is(err, errSimulatedFailure) {
+		return OutcomeSimulatedFail
+	}
+	return OutcomeNetworkError
+}
+
+// flushConfig carries the flush loop's tuning knobs. batchSize is mutable:
+// it gets negotiated downward if the server ever responds 413, so it has to
+// live behind a pointer shared by flushOnce/flushDrained rather than being
+// passed by value.
+type flushConfig struct {
+	client        *http.Client
+	url           string
+	batchSize     int
+	serverErrProb float64
+	logger        *zap.Logger
+	metrics       *Metrics
+
+	retryBase        time.Duration
+	retryMax         time.Duration
+	retryMaxAttempts int
+
+	breakerThreshold int // consecutive failed flush rounds before tripping
+	breakerCooldown  time.Duration
+	breakerUntil     time.Time
+	consecutiveFails int
+}
+
+// BatchSize reports the current negotiated batch size.
+func (c *flushConfig) BatchSize() int {
+	return c.batchSize
+}
+
+// recordFlushFailure counts a whole-round flush failure toward the circuit
+// breaker, tripping it (pausing all flushing for breakerCooldown) once
+// breakerThreshold consecutive rounds have failed.
+func (c *flushConfig) recordFlushFailure() {
+	c.consecutiveFails++
+	if c.breakerThreshold > 0 && c.consecutiveFails >= c.breakerThreshold {
+		c.breakerUntil = time.Now().Add(c.breakerCooldown)
+		c.logger.Warn("circuit breaker tripped; pausing flushes",
+			logging.Attempt(c.consecutiveFails), zap.Duration("cooldown", c.breakerCooldown))
+		c.consecutiveFails = 0
+	}
+}
+
+func (c *flushConfig) recordFlushSuccess() {
+	c.consecutiveFails = 0
+}
+
+type Session struct {
+	StartUTC time.Time
+	Duration int // target run_seconds for this session (random)
+	Closed   bool
+}
+
+func main() {
+	// ---- Flags / configuration ----
+	var (
+		ingestURL         = flag.String("url", envOr("INGEST_URL", "http://127.0.0.1:8080/ingest"), "Server ingest URL")
+		batchURL          = flag.String("batchUrl", envOr("INGEST_BATCH_URL", ""), "Server batch ingest URL (defaults to <url>/batch)")
+		deviceID          = flag.String("device", envOr("DEVICE_ID", "airplane-N20503"), "Device ID")
+		sessions          = flag.Int("sessions", 5, "How many sessions to simulate")
+		minDurMin         = flag.Int("minSessionMin", 5, "Minimum session duration (minutes)")
+		maxDurMin         = flag.Int("maxSessionMin", 60, "Maximum session duration (minutes)")
+		tickRealMS        = flag.Int("tickMS", 200, "Real milliseconds per simulated device minute")
+		updateEvery       = flag.Int("updateEveryMin", 1, "Post an update every N simulated minutes")
+		offlineProb       = flag.Float64("offlineProb", 0.2, "Probability [0..1] that the device is offline at a tick")
+		serverErrProb     = flag.Float64("serverErrProb", 0.1, "Probability [0..1] of server error (simulated client-side)")
+		batchSize         = flag.Int("batch", 8, "Max queued updates to send per flush cycle")
+		flushEveryMS      = flag.Int("flushEveryMS", 400, "Attempt to flush outbox every N ms")
+		jitterMS          = flag.Int("jitterMS", 75, "Random jitter added to each tick (Â±)")
+		seed              = flag.Int64("seed", time.Now().UnixNano(), "RNG seed")
+		outboxDir         = flag.String("outboxDir", envOr("OUTBOX_DIR", ""), "Directory for a durable WAL-backed outbox (empty = in-memory only, lost on restart)")
+		fsyncEveryMS      = flag.Int("fsyncEveryMS", 1000, "How often to fsync the outbox WAL, in ms (0 = fsync after every write)")
+		outboxMaxBytes    = flag.Int64("outboxMaxBytes", 8<<20, "Compact the outbox WAL once it grows past this many bytes")
+		retryBaseMS       = flag.Int("retryBaseMS", 250, "Base delay for per-item exponential backoff, in ms")
+		retryMaxMS        = flag.Int("retryMaxMS", 30000, "Cap on per-item backoff delay, in ms")
+		retryMaxAttempts  = flag.Int("retryMaxAttempts", 8, "Attempts before an item is moved to the dead-letter list")
+		breakerThreshold  = flag.Int("breakerThreshold", 5, "Consecutive failed flush rounds before the circuit breaker trips")
+		breakerCooldownMS = flag.Int("breakerCooldownMS", 5000, "How long the circuit breaker pauses all flushing once tripped, in ms")
+		metricsJSON       = flag.String("metricsJSON", "", "If set, write a JSON latency/throughput report to this path on exit")
+		logLevel          = flag.String("logLevel", "info", "Log level: debug|info|warn|error")
+		logFormat         = flag.String("logFormat", "console", "Log format: console|json")
+	)
+	flag.Parse()
+	rand.Seed(*seed)
+
+	logger, err := logging.New(*logLevel, *logFormat)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer logger.Sync()
+
+	logger.Info("starting simulator", logging.DeviceID(*deviceID), zap.String("url", *ingestURL), zap.Int("sessions", *sessions))
+
+	client := &http.Client{Timeout: 8 * time.Second}
+	metrics := NewMetrics()
+
+	var outbox OutboxStore
+	if *outboxDir != "" {
+		durable, err := NewDurableOutbox(*outboxDir, *outboxMaxBytes, time.Duration(*fsyncEveryMS)*time.Millisecond)
+		if err != nil {
+			logger.Fatal("outbox", zap.Error(err))
+		}
+		defer durable.Close()
+		outbox = durable
+		logger.Info("durable outbox replayed", zap.String("dir", *outboxDir), logging.OutboxDepth(outbox.Len()))
+	} else {
+		outbox = &Outbox{}
+	}
+
+	resolvedBatchURL := *batchURL
+	if resolvedBatchURL == "" {
+		resolvedBatchURL = strings.TrimSuffix(*ingestURL, "/") + "/batch"
+	}
+	cfg := &flushConfig{
+		client:           client,
+		url:              resolvedBatchURL,
+		batchSize:        *batchSize,
+		serverErrProb:    *serverErrProb,
+		logger:           logger,
+		metrics:          metrics,
+		retryBase:        time.Duration(*retryBaseMS) * time.Millisecond,
+		retryMax:         time.Duration(*retryMaxMS) * time.Millisecond,
+		retryMaxAttempts: *retryMaxAttempts,
+		breakerThreshold: *breakerThreshold,
+		breakerCooldown:  time.Duration(*breakerCooldownMS) * time.Millisecond,
+	}
+
+	// Dump a metrics snapshot to stderr on SIGUSR1, without interrupting the run.
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGUSR1)
+	go func() {
+		for range sigCh {
+			metrics.Snapshot(outbox.Len()).WriteText(os.Stderr)
+		}
+	}()
+
+	// Flush loop: periodically try to send queued updates as one batch.
+	// flushStopped is closed once the loop has actually returned, so the
+	// final flushDrained below can wait for it instead of racing it.
+	stopFlush := make(chan struct{})
+	flushStopped := make(chan struct{})
+	go func() {
+		defer close(flushStopped)
+		t := time.NewTicker(time.Duration(*flushEveryMS) * time.Millisecond)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				flushOnce(cfg, outbox, *deviceID)
+			case <-stopFlush:
+				return
+			}
+		}
+	}()
+
+	// Simulate sequential sessions.
+	for i := 0; i < *sessions; i++ {
+		sess := newRandomSession(*minDurMin, *maxDurMin)
+		logger.Info("new session", zap.Int("session_num", i+1), logging.SessionStart(sess.StartUTC.UTC().Format(time.RFC3339)), zap.Int("target_seconds", sess.Duration))
+		simulateSession(sess, *deviceID, *ingestURL, client, outbox, metrics, logger,
+			time.Duration(*tickRealMS), *updateEvery, *offlineProb, *serverErrProb, *jitterMS)
+	}
+
+	// Final flush attempts, then exit. Stop the flush loop goroutine and wait
+	// for it to actually return before calling flushDrained, so flushDrained
+	// is the only thing still touching cfg and the outbox — otherwise both
+	// could PeekBatch the same items and double-POST, and the ticker
+	// goroutine's writes to cfg's mutable fields would race with
+	// flushDrained's.
+	time.Sleep(2 * time.Second)
+	close(stopFlush)
+	<-flushStopped
+	flushDrained(cfg, outbox, *deviceID)
+
+	logger.Info("done", zap.Int("sent", outbox.Sent()), logging.OutboxDepth(outbox.Len()), zap.Int("dead_letter", len(outbox.DeadLetter())))
+
+	report := metrics.Snapshot(outbox.Len())
+	report.WriteText(os.Stdout)
+	if *metricsJSON != "" {
+		if err := report.WriteJSON(*metricsJSON); err != nil {
+			logger.Error("metrics", zap.Error(err))
+		}
+	}
+}
+
+// newRandomSession creates a session with a random duration in minutes.
+func newRandomSession(minMin, maxMin int) *Session {
+	if maxMin < minMin {
+		maxMin = minMin
+	}
+	durMin := minMin + rand.Intn(maxMin-minMin+1)
+	// Start time: sometime within the last 24h
+	start := time.Now().UTC().Add(-time.Duration(rand.Intn(24*60)) * time.Minute)
+	return &Session{
+		StartUTC: start,
+		Duration: durMin * 60, // store as seconds
+		Closed:   false,
+	}
+}
+
+// simulateSession runs one session, producing updates and enqueueing them.
+// "Device minute" advances every tickRealMS; each update increases run_seconds accordingly.
+func simulateSession(
+	sess *Session,
+	deviceID, url string,
+	client *http.Client,
+	outbox OutboxStore,
+	metrics *Metrics,
+	logger *zap.Logger,
+	tickRealMS time.Duration,
+	updateEveryMin int,
+	offlineProb float64,
+	serverErrProb float64,
+	jitterMS int,
+) {
+	if updateEveryMin <= 0 {
+		updateEveryMin = 1
+	}
+	// Simulated device clock
+	runSeconds := 0
+	lastUpdateSentAtMin := -updateEveryMin // force first update at minute 0
+	deviceMinute := 0
+
+	for runSeconds < sess.Duration {
+		// Sleep to simulate one "device minute"
+		sleepMS := int(tickRealMS)
+		if jitterMS > 0 {
+			sleepMS += rand.Intn(2*jitterMS+1) - jitterMS
+			if sleepMS < 1 {
+				sleepMS = 1
+			}
+		}
+		time.Sleep(time.Duration(sleepMS) * time.Millisecond)
+
+		deviceMinute++
+		runSeconds += 60
+
+		// Send update every N device minutes
+		if deviceMinute-lastUpdateSentAtMin >= updateEveryMin {
+			lastUpdateSentAtMin = deviceMinute
+
+			// Build update
+			lastUpdateUTC := sess.StartUTC.Add(time.Duration(runSeconds) * time.Second).UTC()
+			u := &Update{
+				DeviceID:     deviceID,
+				SessionStart: sess.StartUTC.UTC().Format(time.RFC3339),
+				RunSeconds:   runSeconds,
+				LastUpdate:   lastUpdateUTC.Format(time.RFC3339),
+				Status:       "open",
+				MsgID:        fmt.Sprintf("%s:%d", sess.StartUTC.UTC().Format(time.RFC3339), runSeconds),
+			}
+			fields := []zap.Field{logging.DeviceID(deviceID), logging.SessionStart(u.SessionStart), logging.RunSeconds(u.RunSeconds), logging.MsgID(u.MsgID)}
+
+			// Simulate connectivity: sometimes offline
+			online := rand.Float64() > offlineProb
+			if !online {
+				logger.Debug("offline, queueing", fields...)
+				metrics.Record(0, OutcomeQueuedOffline, outbox.Len())
+				if err := outbox.Enqueue(u); err != nil {
+					logger.Warn("enqueue failed", append(fields, zap.Error(err))...)
+				}
+				continue
+			}
+
+			// Try immediate POST; if it fails (error or simulated server failure), queue it.
+			start := time.Now()
+			err := postOnce(client, url, u, serverErrProb, logger)
+			metrics.Record(time.Since(start), classifyPostErr(err), outbox.Len())
+			if err != nil {
+				logger.Debug("post failed, queueing", append(fields, zap.Error(err))...)
+				if err := outbox.Enqueue(u); err != nil {
+					logger.Warn("enqueue failed", append(fields, zap.Error(err))...)
+				}
+			} else {
+				logger.Debug("sent", fields...)
+			}
+		}
+	}
+
+	// Close session with a final update
+	sess.Closed = true
+	final := &Update{
+		DeviceID:     deviceID,
+		SessionStart: sess.StartUTC.UTC().Format(time.RFC3339),
+		RunSeconds:   sess.Duration,
+		LastUpdate:   sess.StartUTC.Add(time.Duration(sess.Duration) * time.Second).UTC().Format(time.RFC3339),
+		Status:       "closed",
+		MsgID:        fmt.Sprintf("%s:%d", sess.StartUTC.UTC().Format(time.RFC3339), sess.Duration),
+	}
+	finalFields := []zap.Field{logging.DeviceID(deviceID), logging.SessionStart(final.SessionStart), logging.RunSeconds(final.RunSeconds), logging.MsgID(final.MsgID)}
+	// Try send; on failure, enqueue
+	start := time.Now()
+	err := postOnce(client, url, final, serverErrProb, logger)
+	metrics.Record(time.Since(start), classifyPostErr(err), outbox.Len())
+	if err != nil {
+		logger.Debug("final post failed, queueing", append(finalFields, zap.Error(err))...)
+		if err := outbox.Enqueue(final); err != nil {
+			logger.Warn("enqueue failed", append(finalFields, zap.Error(err))...)
+		}
+	} else {
+		logger.Debug("sent final (closed)", finalFields...)
+	}
+}
+
+// postOnce sends a single update; returns error if failed or serverErrProb triggers a fake failure.
+func postOnce(client *http.Client, url string, u *Update, serverErrProb float64, logger *zap.Logger) error {
+	logger.Debug("posting update", logging.DeviceID(u.DeviceID), logging.SessionStart(u.SessionStart), logging.RunSeconds(u.RunSeconds), logging.MsgID(u.MsgID))
+	// Simulate server-side errors randomly (client-side)
+	if rand.Float64() < serverErrProb {
+		return errSimulatedFailure
+	}
+	b, _ := json.Marshal(u)
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("server status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// postBatch marshals the whole batch in one request and returns the parsed
+// per-item results. The returned status code is set even on error so the
+// caller can distinguish a 413 (batch too large) from other failures.
+func postBatch(cfg *flushConfig, deviceID string, batch []*Update) (*batchResponse, int, error) {
+	if rand.Float64() < cfg.serverErrProb {
+		return nil, 0, errSimulatedFailure
+	}
+	b, err := json.Marshal(batchRequest{DeviceID: deviceID, Updates: batch})
+	if err != nil {
+		return nil, 0, err
+	}
+	req, err := http.NewRequest(http.MethodPost, cfg.url, bytes.NewReader(b))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := cfg.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, resp.StatusCode, fmt.Errorf("server status %d", resp.StatusCode)
+	}
+	var br batchResponse
+	if err := json.NewDecoder(resp.Body).Decode(&br); err != nil {
+		return nil, resp.StatusCode, err
+	}
+	return &br, resp.StatusCode, nil
+}
+
+// flushOnce sends up to cfg.batchSize queued items that are due for retry as
+// a single /ingest/batch request, acks the items the server reports back as
+// "ok" or "dup", and schedules backoff for the rest instead of blocking
+// everything behind them. Repeated whole-round failures trip a circuit
+// breaker that pauses flushing entirely for a cool-down period.
+func flushOnce(cfg *flushConfig, outbox OutboxStore, deviceID string) {
+	if time.Now().Before(cfg.breakerUntil) {
+		return
+	}
+	batch := outbox.PeekBatch(cfg.batchSize)
+	if len(batch) == 0 {
+		return
+	}
+	start := time.Now()
+	resp, status, err := postBatch(cfg, deviceID, batch)
+	cfg.metrics.Record(time.Since(start), classifyPostErr(err), outbox.Len())
+	if err != nil {
+		if status == http.StatusRequestEntityTooLarge {
+			newSize := cfg.batchSize / 2
+			if newSize < 1 {
+				newSize = 1
+			}
+			cfg.logger.Warn("server rejected batch as too large, reducing batch size",
+				zap.Int("items", len(batch)), zap.Int("old_batch_size", cfg.batchSize), zap.Int("new_batch_size", newSize))
+			cfg.batchSize = newSize
+			return
+		}
+		cfg.logger.Debug("batch post failed, holding items", zap.Int("items", len(batch)),
+			logging.Attempt(cfg.consecutiveFails+1), zap.Error(err))
+		ids := make([]string, len(batch))
+		for i, u := range batch {
+			ids[i] = u.MsgID
+		}
+		logDeadLettered(cfg, outbox.MarkFailed(ids, cfg.retryBase, cfg.retryMax, cfg.retryMaxAttempts))
+		cfg.recordFlushFailure()
+		return
+	}
+	cfg.recordFlushSuccess()
+
+	acked := make([]string, 0, len(resp.Results))
+	var failedIDs []string
+	for _, r := range resp.Results {
+		switch r.Status {
+		case "ok", "dup":
+			acked = append(acked, r.MsgID)
+		default:
+			failedIDs = append(failedIDs, r.MsgID)
+			cfg.logger.Debug("item failed", logging.MsgID(r.MsgID), zap.String("error", r.Error))
+		}
+	}
+	n := outbox.AckSelective(acked)
+	if n > 0 {
+		cfg.logger.Debug("flushed items", zap.Int("acked", n), zap.Int("batch_size", len(batch)))
+	}
+	if len(failedIDs) > 0 {
+		logDeadLettered(cfg, outbox.MarkFailed(failedIDs, cfg.retryBase, cfg.retryMax, cfg.retryMaxAttempts))
+	}
+}
+
+func logDeadLettered(cfg *flushConfig, msgIDs []string) {
+	if len(msgIDs) > 0 {
+		cfg.logger.Warn("items exceeded retryMaxAttempts, moved to dead-letter", zap.Strings("msg_ids", msgIDs))
+	}
+}
+
+// flushDrained keeps flushing until queue stops shrinking or empties.
+func flushDrained(cfg *flushConfig, outbox OutboxStore, deviceID string) {
+	for {
+		before := outbox.Len()
+		if before == 0 {
+			return
+		}
+		flushOnce(cfg, outbox, deviceID)
+		after := outbox.Len()
+		if after >= before {
+			return
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+func envOr(k, def string) string {
+	if v := os.Getenv(k); v != "" {
+		return v
+	}
+	return def
+}